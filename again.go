@@ -0,0 +1,589 @@
+// Package again watches a directory and restarts a command whenever the
+// watched files change, optionally forwarding one or more ports to the
+// child's ephemeral listen ports across restarts. Run is the entry point;
+// cmd/again wraps it into the again CLI.
+package again
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/jchv/again/filenotify"
+	"github.com/jchv/again/internal/logger"
+)
+
+// Options configures a Run call. It mirrors the flags the again CLI
+// accepts; cmd/again builds one of these from flag.Parse and os.Args.
+type Options struct {
+	ForcePoll      bool
+	WatchDir       string
+	Regex          string
+	Ignore         string
+	AddrEnvs       string
+	PortMin        int
+	PortMax        int
+	Quiet          time.Duration
+	MaxDelay       time.Duration
+	StopSignal     string
+	StopTimeout    time.Duration
+	ForwardSignals bool
+	ConfigPath     string
+	LogFormat      string
+	ProxyMode      string
+	HealthPath     string
+	HealthTimeout  time.Duration
+	DrainTimeout   time.Duration
+	Command        []string
+}
+
+// ExitError reports the exit code of the child's last run, so that Run's
+// caller can mirror it via os.Exit without Run itself calling os.Exit.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("child exited with code %d", e.Code)
+}
+
+var (
+	forcePoll      bool
+	watchDir       string
+	regex          string
+	ignore         string
+	addrEnvs       string
+	portMin        int
+	portMax        int
+	quiet          time.Duration
+	maxDelay       time.Duration
+	stopSignalName string
+	stopTimeout    time.Duration
+	forwardSignals bool
+	configPath     string
+	proxyMode      string
+	healthPath     string
+	healthTimeout  time.Duration
+	drainTimeout   time.Duration
+
+	runningMutex sync.Mutex
+	runningCmd   *exec.Cmd
+
+	cmdMutex sync.Mutex
+	cmdArgs  []string
+
+	running int32 // atomic bool: guards against concurrent Run calls, see Run
+)
+
+func getCmdArgs() []string {
+	cmdMutex.Lock()
+	defer cmdMutex.Unlock()
+	return cmdArgs
+}
+
+func setCmdArgs(args []string) {
+	cmdMutex.Lock()
+	defer cmdMutex.Unlock()
+	cmdArgs = args
+}
+
+// signalNames maps the names accepted by -stop-signal to their syscall
+// values. Only the signals that make sense to send to a child process are
+// offered; anything else is a usage error.
+var signalNames = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalNames[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal %q", name)
+	}
+	return sig, nil
+}
+
+// Batch is the coalesced changeset an aggregator round produces: every path
+// touched since the last flush, with its fsnotify ops OR'd together. It's
+// exposed (rather than a bare struct{}) so a restart trigger can eventually
+// be dispatched based on what actually changed.
+type Batch struct {
+	Paths map[string]fsnotify.Op
+}
+
+// aggregator buffers incoming fsnotify events into a single Batch keyed by
+// cleaned path, deduplicating repeated events against the same file. It
+// flushes after a "quiet" period with no further events, or unconditionally
+// once "maxDelay" has elapsed since the first unflushed event, so sustained
+// churn (e.g. a git checkout of hundreds of files) still fires promptly
+// instead of being debounced forever. accept is consulted per-event so
+// ignored paths are dropped before they ever enter the batch. It returns
+// once ctx is cancelled.
+func aggregator(ctx context.Context, quiet, maxDelay time.Duration, input chan fsnotify.Event, output chan Batch, accept func(path string) bool) {
+	batch := map[string]fsnotify.Op{}
+	var quietTimer, maxTimer *time.Timer
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		pending := batch
+		batch = map[string]fsnotify.Op{}
+
+		if quietTimer != nil {
+			quietTimer.Stop()
+			quietTimer = nil
+		}
+		if maxTimer != nil {
+			maxTimer.Stop()
+			maxTimer = nil
+		}
+
+		logger.Debugf("aggregator", "Flushing batch of %d path(s)", len(pending))
+		output <- Batch{Paths: pending}
+	}
+
+	for {
+		var quietC, maxC <-chan time.Time
+		if quietTimer != nil {
+			quietC = quietTimer.C
+		}
+		if maxTimer != nil {
+			maxC = maxTimer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case ev := <-input:
+			if !accept(ev.Name) {
+				continue
+			}
+
+			logger.Debugf("aggregator", "Batching %s (%s)", ev.Name, ev.Op)
+			batch[filepath.Clean(ev.Name)] |= fsnotify.Op(ev.Op)
+
+			if quietTimer != nil {
+				quietTimer.Stop()
+			}
+			quietTimer = time.NewTimer(quiet)
+
+			if maxTimer == nil {
+				maxTimer = time.NewTimer(maxDelay)
+			}
+
+		case <-quietC:
+			flush()
+
+		case <-maxC:
+			flush()
+		}
+	}
+}
+
+// stopChild sends sig to the child's process group and waits up to timeout
+// for it to exit, escalating to SIGKILL if it doesn't. It waits via
+// cmd.Wait rather than cmd.Process.Wait so that cmd.ProcessState (and thus
+// its exit code) gets populated for the caller.
+func stopChild(cmd *exec.Cmd, sig syscall.Signal, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+
+	logger.Debugf("runner", "Sending %s to process group %d", sig, cmd.Process.Pid)
+	syscall.Kill(-cmd.Process.Pid, sig)
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Warnf("Child did not exit within %s - sending SIGKILL", timeout)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+}
+
+// runner starts the child, restarting it on every batch that arrives on
+// changes, until ctx is cancelled. It then stops the child one last time
+// and returns its exit code, for Run to surface to its caller.
+func runner(ctx context.Context, changes chan Batch) int {
+	stopSignal, _ := parseSignal(stopSignalName)
+
+	for {
+		logger.Debugf("runner", "Executing command...")
+
+		args := getCmdArgs()
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = os.Environ()
+		portMapMutex.Lock()
+		for _, mapper := range portMap {
+			port := mapper.Cycle()
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=localhost:%d", mapper.env, port))
+		}
+		portMapMutex.Unlock()
+
+		err := cmd.Start()
+		if err != nil {
+			logger.Errorf("Error executing command: %s", err)
+			return 1
+		}
+
+		runningMutex.Lock()
+		runningCmd = cmd
+		runningMutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			logger.Infof("Shutting down, stopping child...")
+			stopChild(cmd, stopSignal, stopTimeout)
+
+			runningMutex.Lock()
+			runningCmd = nil
+			runningMutex.Unlock()
+
+			if cmd.ProcessState != nil {
+				return cmd.ProcessState.ExitCode()
+			}
+			return 0
+
+		case batch := <-changes:
+			logger.Infof("%d path(s) changed, reloading...", len(batch.Paths))
+			for path, op := range batch.Paths {
+				logger.Debugf("watch", "Changed: %s (%s)", path, op)
+			}
+
+			stopChild(cmd, stopSignal, stopTimeout)
+
+			runningMutex.Lock()
+			runningCmd = nil
+			runningMutex.Unlock()
+		}
+	}
+}
+
+// Run applies opts and watches opts.WatchDir, restarting opts.Command
+// whenever a matching file changes, until ctx is cancelled. On return, the
+// watcher and any port forwarders have been stopped and the child has been
+// asked to exit; the error is an *ExitError carrying its exit code if it
+// exited non-zero.
+//
+// The CLI builds ctx from signal.NotifyContext(context.Background(),
+// os.Interrupt, syscall.SIGTERM), so again's own SIGINT/SIGTERM triggers
+// this same graceful shutdown; embedders can cancel ctx for any reason.
+//
+// Run's state (matchers, the port map, the running command, ...) lives in
+// package variables rather than an instance, so only one Run call may be
+// in flight per process; a second, concurrent call returns an error
+// immediately instead of corrupting the first's state.
+func Run(ctx context.Context, opts Options) error {
+	if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+		return fmt.Errorf("again: Run is already in progress in this process")
+	}
+	defer atomic.StoreInt32(&running, 0)
+
+	forcePoll = opts.ForcePoll
+	watchDir = opts.WatchDir
+	regex = opts.Regex
+	ignore = opts.Ignore
+	addrEnvs = opts.AddrEnvs
+	portMin = opts.PortMin
+	portMax = opts.PortMax
+	quiet = opts.Quiet
+	maxDelay = opts.MaxDelay
+	stopSignalName = opts.StopSignal
+	stopTimeout = opts.StopTimeout
+	forwardSignals = opts.ForwardSignals
+	configPath = opts.ConfigPath
+	proxyMode = opts.ProxyMode
+	healthPath = opts.HealthPath
+	healthTimeout = opts.HealthTimeout
+	drainTimeout = opts.DrainTimeout
+	setCmdArgs(opts.Command)
+
+	switch opts.LogFormat {
+	case "text":
+		logger.SetFormat(logger.FormatText)
+	case "json":
+		logger.SetFormat(logger.FormatJSON)
+	default:
+		return fmt.Errorf("-log-format must be \"text\" or \"json\"")
+	}
+
+	switch proxyMode {
+	case "tcp", "http":
+	default:
+		return fmt.Errorf("-proxy-mode must be \"tcp\" or \"http\"")
+	}
+
+	if configPath != "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			return fmt.Errorf("could not load -config: %w", err)
+		}
+		if err := applyConfig(cfg); err != nil {
+			return fmt.Errorf("could not apply -config: %w", err)
+		}
+	}
+
+	if len(getCmdArgs()) < 1 {
+		return fmt.Errorf("you must provide a command to run, either as arguments or via -config's command")
+	}
+
+	if _, err := parseSignal(stopSignalName); err != nil {
+		return fmt.Errorf("-stop-signal %s", err)
+	}
+
+	initPortCycle(portMin)
+
+	addrEnvMap, err := parseAddrEnvs(addrEnvs)
+	if err != nil {
+		return fmt.Errorf("-addr-env %s", err)
+	}
+
+	portMapMutex.Lock()
+	for port, env := range addrEnvMap {
+		portMap[port] = newPortForwarder(ctx, env, port)
+	}
+	portMapMutex.Unlock()
+
+	var watcher filenotify.FileWatcher
+
+	// Setup watcher
+	if forcePoll {
+		watcher = filenotify.NewPollingWatcher()
+	} else {
+		watcher, err = filenotify.NewEventWatcher()
+		if err != nil {
+			logger.Warnf("Couldn't create event watcher (%s,) falling back to polling watcher.", err)
+			logger.Infof("HINT: Use -poll to force polling.")
+			watcher = filenotify.NewPollingWatcher()
+		}
+	}
+
+	// Setup matchers. matcher/unmatcher are read from the aggregator
+	// goroutine (via accept) and rewritten from this goroutine on every
+	// -config reload, so they're guarded by matchMu rather than accessed
+	// as plain variables.
+	var matchMu sync.Mutex
+	matcher, err := regexp.Compile(regex)
+	if err != nil {
+		return fmt.Errorf("-regex: %w", err)
+	}
+	unmatcher, err := regexp.Compile(ignore)
+	if err != nil {
+		return fmt.Errorf("-ignore: %w", err)
+	}
+
+	setMatchers := func(m, u *regexp.Regexp) {
+		matchMu.Lock()
+		matcher, unmatcher = m, u
+		matchMu.Unlock()
+	}
+	getMatchers := func() (*regexp.Regexp, *regexp.Regexp) {
+		matchMu.Lock()
+		defer matchMu.Unlock()
+		return matcher, unmatcher
+	}
+
+	watchedPaths := map[string]bool{}
+
+	watch := func(path string, info os.FileInfo) {
+		matcher, unmatcher := getMatchers()
+		include := matcher.MatchString(path)
+		exclude := unmatcher.MatchString(path)
+		if (include || info.IsDir()) && !exclude {
+			logger.Debugf("watch", "Watching %s", path)
+
+			watcher.Add(path)
+			watchedPaths[path] = true
+		} else {
+			logger.Debugf("watch", "Ignoring %s", path)
+		}
+	}
+
+	signalin, signalout := make(chan fsnotify.Event, 64), make(chan Batch, 64)
+	accept := func(path string) bool {
+		matcher, unmatcher := getMatchers()
+		return matcher.MatchString(path) && !unmatcher.MatchString(path)
+	}
+
+	// Walk directories for files to watch.
+	err = filepath.Walk(watchDir, func(path string, info os.FileInfo, err error) error {
+		watch(path, info)
+		return nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("could not walk directories: %w", err)
+	}
+
+	// If running in config mode, watch the config file itself so changes to
+	// it can be hot-reloaded below.
+	if configPath != "" {
+		watcher.Add(configPath)
+	}
+
+	reloadConfig := func() {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			logger.Errorf("Error reloading -config: %s", err)
+			return
+		}
+
+		if err := applyConfig(cfg); err != nil {
+			logger.Errorf("Error reloading -config: %s", err)
+			return
+		}
+
+		newMatcher, err := regexp.Compile(regex)
+		if err != nil {
+			logger.Errorf("Error reloading -config: regex invalid: %s", err)
+			return
+		}
+		newUnmatcher, err := regexp.Compile(ignore)
+		if err != nil {
+			logger.Errorf("Error reloading -config: ignore invalid: %s", err)
+			return
+		}
+		setMatchers(newMatcher, newUnmatcher)
+
+		if err := reconcilePortMap(ctx); err != nil {
+			logger.Errorf("Error reloading -config: %s", err)
+			return
+		}
+
+		// Diff the watched-path set against what the new matcher/ignore
+		// pair and watchDir would produce, and Add/Remove only the delta.
+		matcher, unmatcher := getMatchers()
+		newPaths := map[string]bool{}
+		err = filepath.Walk(watchDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			include := matcher.MatchString(path)
+			exclude := unmatcher.MatchString(path)
+			if (include || info.IsDir()) && !exclude {
+				newPaths[path] = true
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Errorf("Error re-walking %s for config reload: %s", watchDir, err)
+			return
+		}
+
+		for path := range watchedPaths {
+			if !newPaths[path] {
+				watcher.Remove(path)
+				delete(watchedPaths, path)
+			}
+		}
+		for path := range newPaths {
+			if !watchedPaths[path] {
+				watcher.Add(path)
+				watchedPaths[path] = true
+			}
+		}
+
+		logger.Infof("Config reloaded from %s", configPath)
+		signalout <- Batch{Paths: map[string]fsnotify.Op{configPath: fsnotify.Write}}
+	}
+
+	events, errors := watcher.Events(), watcher.Errors()
+
+	go aggregator(ctx, quiet, maxDelay, signalin, signalout, accept)
+
+	exitCodeCh := make(chan int, 1)
+	go func() {
+		exitCodeCh <- runner(ctx, signalout)
+	}()
+
+	// SIGHUP isn't part of ctx's signal set (that's reserved for the
+	// graceful shutdown below), so -forward-signals gets its own listener
+	// to relay it straight to the child's process group.
+	if forwardSignals {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case sig := <-sigCh:
+					runningMutex.Lock()
+					cmd := runningCmd
+					runningMutex.Unlock()
+					if cmd != nil {
+						logger.Infof("Received %s - forwarding to child", sig)
+						syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+					}
+				}
+			}
+		}()
+	}
+
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+
+		case event := <-events:
+			if configPath != "" && filepath.Clean(event.Name) == filepath.Clean(configPath) {
+				reloadConfig()
+				continue
+			}
+
+			signalin <- event
+
+			switch fsnotify.Op(event.Op) {
+			case fsnotify.Create:
+				logger.Debugf("fs", "Stat %s", event.Name)
+				info, err := os.Stat(event.Name)
+				if err != nil {
+					logger.Errorf("Error: %s", err)
+				}
+				watch(event.Name, info)
+			case fsnotify.Remove:
+				logger.Debugf("fs", "Unwatching %s", event.Name)
+				watcher.Remove(event.Name)
+				delete(watchedPaths, event.Name)
+			}
+		case err := <-errors:
+			logger.Errorf("Error: %s", err)
+		}
+	}
+
+	if closer, ok := watcher.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Warnf("Error closing watcher: %s", err)
+		}
+	}
+
+	if code := <-exitCodeCh; code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
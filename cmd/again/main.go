@@ -0,0 +1,62 @@
+// Command again watches a directory and restarts a command whenever the
+// watched files change. See `again -h` for flags, or Run in the root
+// package for embedding again in another program.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/jchv/again"
+	"github.com/jchv/again/internal/logger"
+)
+
+func main() {
+	var opts again.Options
+
+	flag.BoolVar(&opts.ForcePoll, "poll", false, "Use polling instead of events.")
+	flag.StringVar(&opts.WatchDir, "watch", ".", "Directory to watch.")
+	flag.StringVar(&opts.Regex, "regex", ".*", "Regular expression of filenames to watch.")
+	flag.StringVar(&opts.Ignore, "ignore", "\\.git", "Regular expression of filenames to ignore.")
+	flag.StringVar(&opts.AddrEnvs, "addr-env", "", "List of envs to forward addresses on, e.g. ADDR:8080.")
+	flag.IntVar(&opts.PortMin, "port-min", 50000, "First port to allocate for forwarding.")
+	flag.IntVar(&opts.PortMax, "port-max", 60000, "Last port to allocate for forwarding.")
+	flag.DurationVar(&opts.Quiet, "quiet", 250*time.Millisecond, "How long to wait for no further changes before restarting.")
+	flag.DurationVar(&opts.MaxDelay, "max-delay", 2*time.Second, "Maximum time to hold off restarting once changes start arriving, even under sustained churn.")
+	flag.StringVar(&opts.StopSignal, "stop-signal", "SIGTERM", "Signal to send the child process when stopping it.")
+	flag.DurationVar(&opts.StopTimeout, "stop-timeout", 5*time.Second, "How long to wait for the child to exit after -stop-signal before sending SIGKILL.")
+	flag.BoolVar(&opts.ForwardSignals, "forward-signals", false, "Forward SIGHUP received by again to the child process.")
+	flag.StringVar(&opts.ConfigPath, "config", "", "Path to a YAML config file of watch/regex/ignore/addr-env/command settings. The file is itself watched and hot-reloaded.")
+	flag.StringVar(&opts.LogFormat, "log-format", "text", "Log output format: text or json.")
+	flag.StringVar(&opts.ProxyMode, "proxy-mode", "tcp", "Port forwarding mode: tcp (raw relay) or http (health-gated reverse proxy).")
+	flag.StringVar(&opts.HealthPath, "health-path", "/healthz", "Path probed on the new child before an http-mode forwarder cuts over to it.")
+	flag.DurationVar(&opts.HealthTimeout, "health-timeout", 10*time.Second, "How long an http-mode forwarder polls -health-path on the new child, and how long a held request waits before getting a 503. If the probe never succeeds, requests stay held.")
+	flag.DurationVar(&opts.DrainTimeout, "drain-timeout", 5*time.Second, "How long a tcp-mode forwarder waits for in-flight connections to finish before cutting over.")
+	flag.Parse()
+
+	opts.Command = flag.Args()
+
+	if opts.ConfigPath == "" && len(opts.Command) < 1 {
+		logger.Fatalf("You must provide a command to run.")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := again.Run(ctx, opts)
+
+	var exitErr *again.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		os.Exit(exitErr.Code)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, "again:", err)
+		os.Exit(1)
+	}
+}
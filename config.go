@@ -0,0 +1,119 @@
+package again
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config mirrors the flags that again accepts on the command line. It lets
+// a long-running again process be retuned by editing a file instead of
+// restarting with new flags; see -config and the config-reload handling in
+// again.go. Quiet and MaxDelay take effect only at startup: the aggregator
+// keeps the values it started with, so changing them in a reload has no
+// effect on the running process.
+type Config struct {
+	Watch    string   `yaml:"watch"`
+	Regex    string   `yaml:"regex"`
+	Ignore   string   `yaml:"ignore"`
+	AddrEnv  string   `yaml:"addr-env"`
+	PortMin  int      `yaml:"port-min"`
+	PortMax  int      `yaml:"port-max"`
+	Quiet    string   `yaml:"quiet"`
+	MaxDelay string   `yaml:"max-delay"`
+	Command  []string `yaml:"command"`
+}
+
+// loadConfig reads and parses the YAML config file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// applyConfig copies any fields set in cfg over the corresponding global
+// flag variables. Fields left at their zero value do not override whatever
+// was set on the command line. It returns an error, rather than exiting the
+// process, on a malformed quiet/max-delay duration: applyConfig runs both at
+// startup (via Run, which surfaces the error to its caller) and on every
+// -config reload (via reloadConfig, which logs it and keeps the old value),
+// and a typo in a file the user is actively editing shouldn't take down an
+// otherwise-healthy run.
+func applyConfig(cfg *Config) error {
+	if cfg.Watch != "" {
+		watchDir = cfg.Watch
+	}
+	if cfg.Regex != "" {
+		regex = cfg.Regex
+	}
+	if cfg.Ignore != "" {
+		ignore = cfg.Ignore
+	}
+	if cfg.AddrEnv != "" {
+		addrEnvs = cfg.AddrEnv
+	}
+	if cfg.PortMin != 0 {
+		portMin = cfg.PortMin
+	}
+	if cfg.PortMax != 0 {
+		portMax = cfg.PortMax
+	}
+	if cfg.Quiet != "" {
+		d, err := time.ParseDuration(cfg.Quiet)
+		if err != nil {
+			return fmt.Errorf("config quiet invalid: %w", err)
+		}
+		quiet = d
+	}
+	if cfg.MaxDelay != "" {
+		d, err := time.ParseDuration(cfg.MaxDelay)
+		if err != nil {
+			return fmt.Errorf("config max-delay invalid: %w", err)
+		}
+		maxDelay = d
+	}
+	if len(cfg.Command) > 0 {
+		setCmdArgs(cfg.Command)
+	}
+	return nil
+}
+
+// reconcilePortMap brings portMap in line with the addr-env pairs in
+// addrEnvs, starting forwarders for new entries and closing the ones that
+// were removed. It is used when a config reload changes -addr-env. New
+// forwarders share ctx with the rest of the run, so they stop along with
+// everything else on shutdown.
+func reconcilePortMap(ctx context.Context) error {
+	wanted, err := parseAddrEnvs(addrEnvs)
+	if err != nil {
+		return err
+	}
+
+	portMapMutex.Lock()
+	defer portMapMutex.Unlock()
+
+	for port, fwd := range portMap {
+		if _, ok := wanted[port]; !ok {
+			fwd.Close()
+			delete(portMap, port)
+		}
+	}
+
+	for port, env := range wanted {
+		if _, ok := portMap[port]; !ok {
+			portMap[port] = newPortForwarder(ctx, env, port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package again
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jchv/again/internal/logger"
+)
+
+var (
+	portMutex sync.Mutex
+	portCycle uint16
+
+	portMapMutex sync.Mutex
+	portMap      = map[uint16]*portForwarder{}
+)
+
+func initPortCycle(min int) {
+	portMutex.Lock()
+	portCycle = uint16(min) - 1
+	portMutex.Unlock()
+}
+
+func nextPort() uint16 {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+
+	portCycle++
+	if portCycle == uint16(portMax) {
+		portCycle = uint16(portMin)
+	}
+
+	return portCycle
+}
+
+// parseAddrEnvs parses the comma-separated "-addr-env" syntax (e.g.
+// "ADDR:8080,OTHER_ADDR:8081") into a port -> env name map. Syntax errors
+// are returned rather than fatal: this runs both at startup (via Run) and
+// on every -config reload (via reconcilePortMap), and the latter shouldn't
+// take down an otherwise-healthy run over a typo.
+func parseAddrEnvs(addrEnvs string) (map[uint16]string, error) {
+	out := map[uint16]string{}
+	for _, addrEnv := range strings.Split(addrEnvs, ",") {
+		if addrEnv == "" {
+			continue
+		}
+		parts := strings.SplitN(addrEnv, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("addr-env pair missing port: %q", addrEnv)
+		}
+		env := parts[0]
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("addr-env pair port invalid: %q", addrEnv)
+		}
+
+		out[uint16(port)] = env
+	}
+	return out, nil
+}
+
+// portForwarder exposes a child process's port to the outside world on a
+// stable -addr-env port, forwarding to whichever ephemeral port the current
+// child instance is bound to. In -proxy-mode=tcp it's a raw byte-for-byte
+// relay; in -proxy-mode=http it reverse-proxies HTTP requests and holds new
+// requests across a reload until the new child passes a health probe.
+type portForwarder struct {
+	env  string
+	src  uint16
+	dest uint32
+	mode string
+
+	listener net.Listener
+	conns    sync.WaitGroup // in-flight tcp connections, for -drain-timeout
+
+	server *http.Server
+
+	holding int32  // atomic bool: gate new HTTP requests during cutover
+	gen     uint32 // atomic: generation of the current/last beginHTTPCutover call
+	readyMu sync.Mutex
+	readyCh chan struct{}
+}
+
+func newPortForwarder(ctx context.Context, env string, src uint16) *portForwarder {
+	p := &portForwarder{
+		env:     env,
+		src:     src,
+		mode:    proxyMode,
+		readyCh: closedChan(),
+	}
+
+	go p.Run(ctx)
+
+	return p
+}
+
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// Cycle allocates the next destination port. In tcp mode it waits (up to
+// -drain-timeout) for in-flight connections against the old destination to
+// finish before cutting over. In http mode the cutover is asynchronous: new
+// requests are held until the new destination passes a health probe.
+func (p *portForwarder) Cycle() uint16 {
+	port := nextPort()
+	logger.Debugf("proxy", "Cycling %s forwarder for %s to port %d", p.mode, p.env, port)
+
+	if p.mode == "http" {
+		p.beginHTTPCutover(port)
+		return port
+	}
+
+	if !waitGroupTimeout(&p.conns, drainTimeout) {
+		logger.Warnf("Forwarder for %s did not drain within %s, cutting over anyway", p.env, drainTimeout)
+	}
+	atomic.StoreUint32(&p.dest, uint32(port))
+	return port
+}
+
+// Close stops the forwarder from accepting new connections. It is used when
+// a config reload removes an -addr-env entry.
+func (p *portForwarder) Close() error {
+	if p.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		return p.server.Shutdown(ctx)
+	}
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	return nil
+}
+
+// Run accepts connections/requests for the forwarder's lifetime, closing
+// its listener (or shutting down its server) once ctx is cancelled.
+func (p *portForwarder) Run(ctx context.Context) error {
+	if p.mode == "http" {
+		return p.runHTTP(ctx)
+	}
+	return p.runTCP(ctx)
+}
+
+func (p *portForwarder) runTCP(ctx context.Context) error {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", p.src))
+
+	if err != nil {
+		return err
+	}
+	p.listener = l
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		// Wait for connections
+		sock, err := l.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		p.conns.Add(1)
+
+		// Connect to remote
+		dest := atomic.LoadUint32(&p.dest)
+		raddr := fmt.Sprintf("localhost:%d", dest)
+		logger.Debugf("proxy", "Forwarding %s -> %s", sock.RemoteAddr(), raddr)
+		remote, err := net.Dial("tcp", raddr)
+
+		if err != nil {
+			logger.Warnf("Could not connect to %s", raddr)
+			sock.Close()
+			p.conns.Done()
+			continue
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+
+		// Read thread
+		go func() {
+			io.Copy(sock, remote)
+			sock.Close()
+			wg.Done()
+		}()
+
+		// Write thread
+		go func() {
+			io.Copy(remote, sock)
+			sock.Close()
+			wg.Done()
+		}()
+
+		go func() {
+			wg.Wait()
+			p.conns.Done()
+		}()
+	}
+}
+
+// runHTTP reverse-proxies HTTP requests to the current destination port,
+// holding new requests during a cutover (see beginHTTPCutover) rather than
+// letting them hit connection-refused against a child that's still starting.
+func (p *portForwarder) runHTTP(ctx context.Context) error {
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			dest := atomic.LoadUint32(&p.dest)
+			req.URL.Scheme = "http"
+			req.URL.Host = fmt.Sprintf("localhost:%d", dest)
+			logger.Debugf("proxy", "Forwarding %s %s -> %s", req.Method, req.URL.Path, req.URL.Host)
+		},
+	}
+
+	p.server = &http.Server{
+		Addr: fmt.Sprintf(":%d", p.src),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&p.holding) == 1 {
+				select {
+				case <-p.waitReady():
+				case <-time.After(healthTimeout):
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte("rebuilding\n"))
+					return
+				}
+			}
+			proxy.ServeHTTP(w, r)
+		}),
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		p.server.Shutdown(shutdownCtx)
+	}()
+
+	err := p.server.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (p *portForwarder) waitReady() chan struct{} {
+	p.readyMu.Lock()
+	defer p.readyMu.Unlock()
+	return p.readyCh
+}
+
+// beginHTTPCutover holds new requests and polls -health-path on port until
+// it answers with a 2xx, then flips the atomic destination and releases
+// whatever requests were queued waiting on it. If another cutover starts
+// before this one finishes (e.g. two reloads within -health-timeout), gen
+// lets this one notice it's been superseded and bow out without touching
+// p.dest, p.holding, or the newer cutover's p.readyCh.
+func (p *portForwarder) beginHTTPCutover(port uint16) {
+	gen := atomic.AddUint32(&p.gen, 1)
+
+	p.readyMu.Lock()
+	ready := make(chan struct{})
+	p.readyCh = ready
+	p.readyMu.Unlock()
+
+	atomic.StoreInt32(&p.holding, 1)
+
+	go func() {
+		deadline := time.Now().Add(healthTimeout)
+		url := fmt.Sprintf("http://localhost:%d%s", port, healthPath)
+		healthy := false
+
+		for time.Now().Before(deadline) {
+			resp, err := http.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+					healthy = true
+					break
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if atomic.LoadUint32(&p.gen) != gen {
+			// A newer cutover superseded this one; let it own dest/holding/readyCh.
+			return
+		}
+
+		if !healthy {
+			logger.Warnf("Forwarder for %s did not pass %s within %s, continuing to hold requests", p.env, healthPath, healthTimeout)
+			return
+		}
+
+		atomic.StoreUint32(&p.dest, uint32(port))
+		atomic.StoreInt32(&p.holding, 0)
+		close(ready)
+	}()
+}
+
+// waitGroupTimeout waits for wg up to timeout, reporting whether it
+// finished in time.
+func waitGroupTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,131 @@
+// Package logger provides again's leveled logging, including the
+// AGAIN_TRACE-gated debug categories used to trace why a rebuild did or
+// didn't fire without drowning in per-file spam.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format selects how log lines are rendered.
+type Format string
+
+// Supported output formats.
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+var (
+	mu            sync.Mutex
+	format        = FormatText
+	categories    = map[string]bool{}
+	allCategories bool
+)
+
+func init() {
+	loadTrace(os.Getenv("AGAIN_TRACE"))
+}
+
+// loadTrace parses the AGAIN_TRACE syntax: a comma-separated list of
+// categories (watch, fs, proxy, runner, aggregator), or "all".
+func loadTrace(trace string) {
+	cats := map[string]bool{}
+	all := false
+	for _, c := range strings.Split(trace, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch c {
+		case "":
+		case "all":
+			all = true
+		default:
+			cats[c] = true
+		}
+	}
+
+	mu.Lock()
+	categories, allCategories = cats, all
+	mu.Unlock()
+}
+
+// SetFormat selects text or JSON output; again sets this from -log-format.
+func SetFormat(f Format) {
+	mu.Lock()
+	format = f
+	mu.Unlock()
+}
+
+// enabled reports whether category is gated on by AGAIN_TRACE.
+func enabled(category string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return allCategories || categories[category]
+}
+
+func write(level, category, msg string) {
+	mu.Lock()
+	f := format
+	mu.Unlock()
+
+	if f == FormatJSON {
+		entry := struct {
+			Time     string `json:"time"`
+			Level    string `json:"level"`
+			Category string `json:"category,omitempty"`
+			Message  string `json:"message"`
+		}{
+			Time:     time.Now().Format(time.RFC3339),
+			Level:    level,
+			Category: category,
+			Message:  msg,
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, string(data))
+		return
+	}
+
+	prefix := "[AGAIN] "
+	if category != "" {
+		prefix += "[" + category + "] "
+	}
+	fmt.Fprintln(os.Stderr, prefix+strings.ToUpper(level)+": "+msg)
+}
+
+// Debugf logs a trace-level message under category. It is a no-op unless
+// category is enabled via AGAIN_TRACE.
+func Debugf(category, format string, args ...interface{}) {
+	if !enabled(category) {
+		return
+	}
+	write("debug", category, fmt.Sprintf(format, args...))
+}
+
+// Infof logs an informational message.
+func Infof(format string, args ...interface{}) {
+	write("info", "", fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a recoverable problem.
+func Warnf(format string, args ...interface{}) {
+	write("warn", "", fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a non-fatal error.
+func Errorf(format string, args ...interface{}) {
+	write("error", "", fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs an error and exits, mirroring log.Fatalln.
+func Fatalf(format string, args ...interface{}) {
+	write("error", "", fmt.Sprintf(format, args...))
+	os.Exit(1)
+}